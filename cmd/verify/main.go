@@ -0,0 +1,259 @@
+// Copyright 2025 Stephen Connolly
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command verify walks the archive and checks that every station's dated
+// CSV snapshots are well-formed and up to date. It is meant to run as a
+// separate CI job from the fetcher, which is why it lives in its own
+// package under cmd/ rather than alongside main.go.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	dataSourcesFile = "data-sources.yaml"
+	dateFormat      = "2006-01-02"
+	defaultMaxAge   = 2 // days
+)
+
+type DataSources map[string][]string
+
+// snapshotIssue is one problem found with a single snapshot file.
+type snapshotIssue struct {
+	File   string   `json:"file"`
+	URL    string   `json:"url,omitempty"`
+	Issues []string `json:"issues"`
+}
+
+var snapshotNamePattern = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2})\.csv$`)
+
+func main() {
+	maxAgeDays := flag.Int("max-age-days", defaultMaxAge, "maximum allowed age, in days, of the newest snapshot for each URL")
+	flag.Parse()
+
+	dataSources := readDataSources()
+
+	var results []snapshotIssue
+	failed := false
+
+	for dir, urls := range dataSources {
+		newestByURL := make(map[string]time.Time, len(urls))
+		expectedHeader := make(map[string][]string, len(urls))
+		for _, url := range urls {
+			newestByURL[url] = time.Time{}
+		}
+
+		// A missing directory still needs to fall through to the
+		// staleness/"no snapshot" check below for each of its URLs - that's
+		// the clearest case of an archive rotting, so it must not be
+		// silently skipped. A directory that exists but can't be read is a
+		// harder failure and is reported directly instead.
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", dir, err)
+			failed = true
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			m := snapshotNamePattern.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			base, dateStr := m[1], m[2]
+			path := filepath.Join(dir, name)
+
+			url := matchURL(urls, base)
+			header, issues := verifySnapshot(path, dateStr)
+			if url != "" {
+				if fetchedOn, err := time.Parse(dateFormat, dateStr); err == nil {
+					if fetchedOn.After(newestByURL[url]) {
+						newestByURL[url] = fetchedOn
+					}
+				}
+				// The repo doesn't declare a schema for each URL up front, so
+				// treat the first snapshot we see for a URL as the expected
+				// schema and flag any later drift against it.
+				if want, ok := expectedHeader[url]; !ok {
+					if header != nil {
+						expectedHeader[url] = header
+					}
+				} else if header != nil && !equalHeaders(want, header) {
+					issues = append(issues, fmt.Sprintf("header %v does not match expected schema %v for %s", header, want, url))
+				}
+			} else {
+				issues = append(issues, "snapshot does not match any configured URL for this directory")
+			}
+			if len(issues) > 0 {
+				results = append(results, snapshotIssue{File: path, URL: url, Issues: issues})
+				failed = true
+			}
+		}
+
+		cutoff := time.Now().AddDate(0, 0, -*maxAgeDays)
+		for _, url := range urls {
+			if newestByURL[url].IsZero() {
+				results = append(results, snapshotIssue{File: dir, URL: url, Issues: []string{"no snapshot found"}})
+				failed = true
+				continue
+			}
+			if newestByURL[url].Before(cutoff) {
+				results = append(results, snapshotIssue{File: dir, URL: url, Issues: []string{
+					fmt.Sprintf("newest snapshot is from %s, older than %d day(s)", newestByURL[url].Format(dateFormat), *maxAgeDays),
+				}})
+				failed = true
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].File < results[j].File })
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode results: %v\n", err)
+		os.Exit(2)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// matchURL returns the configured URL whose basename (with its extension
+// stripped) matches base, or "" if none matches.
+func matchURL(urls []string, base string) string {
+	for _, url := range urls {
+		urlBase := strings.TrimSuffix(filepath.Base(url), filepath.Ext(url))
+		if urlBase == base {
+			return url
+		}
+	}
+	return ""
+}
+
+// verifySnapshot checks that a single CSV file is parseable and that its
+// row timestamps are strictly monotonic and fall within the day named by
+// dateStr. It returns the parsed header (nil if unreadable) alongside any
+// issues found.
+func verifySnapshot(path, dateStr string) ([]string, []string) {
+	var issues []string
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("cannot open file: %v", err)}
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("cannot read header: %v", err)}
+	}
+	if len(header) == 0 {
+		issues = append(issues, "empty header row")
+	}
+
+	day, err := time.Parse(dateFormat, dateStr)
+	if err != nil {
+		issues = append(issues, fmt.Sprintf("filename date %q is not a valid date", dateStr))
+		return header, issues
+	}
+	windowStart := day
+	windowEnd := day.AddDate(0, 0, 1)
+
+	var prev time.Time
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("cannot parse row: %v", err))
+			break
+		}
+		if len(record) == 0 {
+			continue
+		}
+		ts, err := parseRowTimestamp(record[0])
+		if err != nil {
+			continue // not every schema's first column is a timestamp
+		}
+		if !prev.IsZero() && !ts.After(prev) {
+			issues = append(issues, fmt.Sprintf("row timestamp %s is not strictly after previous %s", ts.Format(time.RFC3339), prev.Format(time.RFC3339)))
+		}
+		if ts.Before(windowStart) || !ts.Before(windowEnd) {
+			issues = append(issues, fmt.Sprintf("row timestamp %s falls outside the %s snapshot window", ts.Format(time.RFC3339), dateStr))
+		}
+		prev = ts
+	}
+
+	return header, issues
+}
+
+func equalHeaders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseRowTimestamp(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "02-jan-2006 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+func readDataSources() DataSources {
+	f, err := os.Open(dataSourcesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", dataSourcesFile, err)
+		os.Exit(2)
+	}
+	defer f.Close()
+
+	var ds DataSources
+	if err := yaml.NewDecoder(f).Decode(&ds); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse %s: %v\n", dataSourcesFile, err)
+		os.Exit(2)
+	}
+	return ds
+}
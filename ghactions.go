@@ -0,0 +1,189 @@
+// Copyright 2025 Stephen Connolly
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isGitHubActions gates every helper in this file: outside Actions, fetchLog
+// and friends fall back to the plain log package so the fetcher's console
+// output is unchanged, and writeJobSummary/writeOutputs are no-ops.
+var isGitHubActions = os.Getenv("GITHUB_ACTIONS") == "true"
+
+// stdoutMu guards every write of workflow-command output, so the worker
+// pool's concurrent goroutines (and fetchLog.flush in particular) can't
+// split each other's writes across the same line.
+var stdoutMu sync.Mutex
+
+// ghNotice, ghWarning and ghError are for workflow-command lines emitted
+// outside of a per-fetch group, such as during startup. Under Actions they
+// become the matching workflow command; otherwise they log exactly as
+// before. Lines that belong to a single fetchOne call should go through a
+// fetchLog instead, so they get grouped and flushed atomically.
+func ghNotice(format string, args ...interface{})  { ghLog("notice", format, args...) }
+func ghWarning(format string, args ...interface{}) { ghLog("warning", format, args...) }
+func ghError(format string, args ...interface{})   { ghLog("error", format, args...) }
+
+func ghLog(level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !isGitHubActions {
+		log.Print(msg)
+		return
+	}
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	fmt.Printf("::%s::%s\n", level, escapeWorkflowData(msg))
+}
+
+// fetchLog buffers the ::group::/::endgroup:: block and the notice/warning/
+// error lines for a single fetchOne call, and writes them to stdout in one
+// shot when the fetch finishes. fetchOne runs concurrently across up to
+// maxParallel worker goroutines, so without this, two fetches' group
+// markers could interleave and corrupt each other's collapsible section in
+// the Actions log.
+type fetchLog struct {
+	buf strings.Builder
+}
+
+// newFetchLog opens name's group in the buffer. It is a no-op outside
+// Actions, same as the rest of this file.
+func newFetchLog(name string) *fetchLog {
+	l := &fetchLog{}
+	if isGitHubActions {
+		fmt.Fprintf(&l.buf, "::group::%s\n", name)
+	}
+	return l
+}
+
+func (l *fetchLog) notice(format string, args ...interface{})  { l.log("notice", format, args...) }
+func (l *fetchLog) warning(format string, args ...interface{}) { l.log("warning", format, args...) }
+func (l *fetchLog) error(format string, args ...interface{})   { l.log("error", format, args...) }
+
+func (l *fetchLog) log(level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !isGitHubActions {
+		log.Print(msg)
+		return
+	}
+	fmt.Fprintf(&l.buf, "::%s::%s\n", level, escapeWorkflowData(msg))
+}
+
+// flush closes the group (if Actions is active) and writes the whole
+// buffered block to stdout as a single Write call, so it can't be split by
+// another fetch's flush.
+func (l *fetchLog) flush() {
+	if !isGitHubActions {
+		return
+	}
+	l.buf.WriteString("::endgroup::\n")
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	os.Stdout.WriteString(l.buf.String())
+}
+
+// escapeWorkflowData escapes a workflow command's data payload per GitHub's
+// documented rules: https://docs.github.com/actions/using-workflow-commands
+func escapeWorkflowData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	s = strings.ReplaceAll(s, "\n", "%0A")
+	return s
+}
+
+// writeJobSummary appends a Markdown table of this run's fetch results, one
+// row per URL, to $GITHUB_STEP_SUMMARY. It is a no-op outside Actions or if
+// the variable isn't set.
+func writeJobSummary(results []fetchResult) error {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if !isGitHubActions || path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, "## Fetch results")
+	fmt.Fprintln(f, "| URL | Status | Bytes | Elapsed | Cache hit |")
+	fmt.Fprintln(f, "| --- | --- | ---: | ---: | :---: |")
+	for _, r := range results {
+		fmt.Fprintf(f, "| %s | %s | %d | %s | %s |\n",
+			r.URL, r.Status, r.Bytes, r.Elapsed.Round(time.Millisecond), checkmark(r.CacheHit))
+	}
+	return nil
+}
+
+func checkmark(hit bool) string {
+	if hit {
+		return "✓"
+	}
+	return ""
+}
+
+// writeOutputs appends each key/value pair to $GITHUB_OUTPUT, using the
+// multiline delimiter form (name<<DELIM\nvalue\nDELIM) for any value
+// containing a newline. It is a no-op outside Actions or if the variable
+// isn't set.
+func writeOutputs(outputs map[string]string) error {
+	path := os.Getenv("GITHUB_OUTPUT")
+	if !isGitHubActions || path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	keys := make([]string, 0, len(outputs))
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := outputs[key]
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(f, "%s=%s\n", key, value)
+			continue
+		}
+		delim, err := randomDelimiter()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "%s<<%s\n%s\n%s\n", key, delim, value, delim)
+	}
+	return nil
+}
+
+// randomDelimiter returns a delimiter for the GITHUB_OUTPUT multiline form
+// that won't collide with a value we didn't generate ourselves.
+func randomDelimiter() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate output delimiter: %w", err)
+	}
+	return "ghadelim_" + hex.EncodeToString(buf), nil
+}
@@ -15,37 +15,272 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	dataSourcesFile = "data-sources.yaml"
 	metadataFile    = ".metadata.yaml"
+	metadataDBFile  = ".metadata.db"
+	metadataBackend = "METADATA_BACKEND" // "yaml" (default) or "sqlite"
 	dateFormat      = "2006-01-02"
 	maxParallel     = 16
 )
 
+// MetadataEntry records what we know about the last successful fetch of a
+// URL, so subsequent runs can avoid re-downloading or re-writing unchanged
+// data.
 type MetadataEntry struct {
-	LastModified string `yaml:"last_modified,omitempty"`
-	ETag         string `yaml:"etag,omitempty"`
+	LastModified  string    `yaml:"last_modified,omitempty"`
+	ETag          string    `yaml:"etag,omitempty"`
+	ContentSHA256 string    `yaml:"content_sha256,omitempty"`
+	Size          int64     `yaml:"size,omitempty"`
+	LastFetchedAt time.Time `yaml:"last_fetched_at,omitempty"`
+
+	// InProgressFile and InProgressOffset let a killed process resume a
+	// partial download next run instead of starting over. Only populated
+	// for the local filesystem backend, since resuming requires random
+	// access to a concrete file path across runs.
+	InProgressFile   string `yaml:"in_progress_file,omitempty"`
+	InProgressOffset int64  `yaml:"in_progress_offset,omitempty"`
 }
 
 type Metadata map[string]MetadataEntry
 type DataSources map[string][]string
 
+// MetadataStore is the persistence layer for MetadataEntry records, keyed by
+// source URL. Implementations must be safe for concurrent use.
+type MetadataStore interface {
+	Get(url string) (MetadataEntry, bool, error)
+	Put(url string, entry MetadataEntry) error
+	List() (Metadata, error)
+	Close() error
+}
+
+// openMetadataStore picks a MetadataStore implementation based on the
+// METADATA_BACKEND environment variable, defaulting to the plain YAML file
+// that has always lived alongside the archive.
+func openMetadataStore() MetadataStore {
+	switch os.Getenv(metadataBackend) {
+	case "sqlite":
+		store, err := newSQLiteMetadataStore(metadataDBFile)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", metadataDBFile, err)
+		}
+		return store
+	default:
+		return newYAMLMetadataStore(metadataFile)
+	}
+}
+
+// yamlMetadataStore is the original backend: the whole map is read once at
+// startup and rewritten atomically at the end of the run.
+type yamlMetadataStore struct {
+	mu   sync.Mutex
+	path string
+	data Metadata
+}
+
+func newYAMLMetadataStore(path string) *yamlMetadataStore {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &yamlMetadataStore{path: path, data: Metadata{}}
+	} else if err != nil {
+		log.Fatalf("Failed to read metadata: %v", err)
+	}
+	defer file.Close()
+
+	var m Metadata
+	if err := yaml.NewDecoder(file).Decode(&m); err != nil {
+		log.Fatalf("Failed to parse metadata: %v", err)
+	}
+	if m == nil {
+		m = Metadata{}
+	}
+	return &yamlMetadataStore{path: path, data: m}
+}
+
+func (s *yamlMetadataStore) Get(url string) (MetadataEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.data[url]
+	return entry, ok, nil
+}
+
+func (s *yamlMetadataStore) Put(url string, entry MetadataEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[url] = entry
+	return nil
+}
+
+func (s *yamlMetadataStore) List() (Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(Metadata, len(s.data))
+	for k, v := range s.data {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *yamlMetadataStore) Close() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enc := yaml.NewEncoder(f)
+	enc.SetIndent(2)
+	if err := enc.Encode(s.data); err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// sqliteMetadataStore is an alternative backend for users who'd rather query
+// the archive's fetch history with SQL than grep a YAML file.
+type sqliteMetadataStore struct {
+	db *sql.DB
+}
+
+func newSQLiteMetadataStore(path string) (*sqliteMetadataStore, error) {
+	// _busy_timeout makes SQLite retry internally instead of immediately
+	// returning SQLITE_BUSY, and WAL lets readers and the one writer
+	// proceed concurrently. We still cap the pool to a single connection
+	// below: the worker pool calls Put up to maxParallel at a time, and
+	// without that cap, concurrent writer connections can still collide
+	// and surface "database is locked" rather than queueing.
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	const schema = `
+CREATE TABLE IF NOT EXISTS metadata (
+	url                TEXT PRIMARY KEY,
+	last_modified      TEXT,
+	etag               TEXT,
+	content_sha256     TEXT,
+	size               INTEGER,
+	last_fetched_at    TEXT,
+	in_progress_file   TEXT,
+	in_progress_offset INTEGER
+);`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteMetadataStore{db: db}, nil
+}
+
+func (s *sqliteMetadataStore) Get(url string) (MetadataEntry, bool, error) {
+	var e MetadataEntry
+	var lastFetchedAt string
+	row := s.db.QueryRow(`SELECT last_modified, etag, content_sha256, size, last_fetched_at, in_progress_file, in_progress_offset FROM metadata WHERE url = ?`, url)
+	switch err := row.Scan(&e.LastModified, &e.ETag, &e.ContentSHA256, &e.Size, &lastFetchedAt, &e.InProgressFile, &e.InProgressOffset); err {
+	case sql.ErrNoRows:
+		return MetadataEntry{}, false, nil
+	case nil:
+		if lastFetchedAt != "" {
+			e.LastFetchedAt, _ = time.Parse(time.RFC3339, lastFetchedAt)
+		}
+		return e, true, nil
+	default:
+		return MetadataEntry{}, false, err
+	}
+}
+
+func (s *sqliteMetadataStore) Put(url string, entry MetadataEntry) error {
+	_, err := s.db.Exec(`
+INSERT INTO metadata (url, last_modified, etag, content_sha256, size, last_fetched_at, in_progress_file, in_progress_offset)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(url) DO UPDATE SET
+	last_modified = excluded.last_modified,
+	etag = excluded.etag,
+	content_sha256 = excluded.content_sha256,
+	size = excluded.size,
+	last_fetched_at = excluded.last_fetched_at,
+	in_progress_file = excluded.in_progress_file,
+	in_progress_offset = excluded.in_progress_offset`,
+		url, entry.LastModified, entry.ETag, entry.ContentSHA256, entry.Size, entry.LastFetchedAt.Format(time.RFC3339), entry.InProgressFile, entry.InProgressOffset)
+	return err
+}
+
+func (s *sqliteMetadataStore) List() (Metadata, error) {
+	rows, err := s.db.Query(`SELECT url, last_modified, etag, content_sha256, size, last_fetched_at, in_progress_file, in_progress_offset FROM metadata`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := Metadata{}
+	for rows.Next() {
+		var url, lastFetchedAt string
+		var e MetadataEntry
+		if err := rows.Scan(&url, &e.LastModified, &e.ETag, &e.ContentSHA256, &e.Size, &lastFetchedAt, &e.InProgressFile, &e.InProgressOffset); err != nil {
+			return nil, err
+		}
+		if lastFetchedAt != "" {
+			e.LastFetchedAt, _ = time.Parse(time.RFC3339, lastFetchedAt)
+		}
+		out[url] = e
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteMetadataStore) Close() error {
+	return s.db.Close()
+}
+
 type fetchTask struct {
-	dir string
-	url string
+	store  Storage
+	prefix string
+	url    string
+}
+
+// fetchStatus summarises how a single fetchOne call ended, for the
+// GitHub Actions job summary table and output variables.
+type fetchStatus string
+
+const (
+	statusUpdated   fetchStatus = "updated"
+	statusUnchanged fetchStatus = "unchanged"
+	statusErrored   fetchStatus = "error"
+)
+
+// fetchResult is what fetchOne reports back about one URL, regardless of
+// whether it succeeded. Err is non-nil only when Status is statusErrored.
+type fetchResult struct {
+	URL      string
+	Status   fetchStatus
+	Bytes    int64
+	Elapsed  time.Duration
+	CacheHit bool
+	Err      error
 }
 
 func main() {
@@ -53,11 +288,21 @@ func main() {
 	today := time.Now().Format(dateFormat)
 
 	dataSources := readDataSources()
-	metadata := readMetadata()
+	metadata := openMetadataStore()
 	tasks := make(chan fetchTask, maxParallel)
 
+	limiter := newHostLimiterFromEnv()
+	client := newPoliteClient(limiter)
+	for host := range hostsOf(dataSources) {
+		if delay := crawlDelayFor(client, host); delay > 0 {
+			ghNotice("Honouring robots.txt Crawl-delay of %s for %s", delay, host)
+			limiter.raiseInterval(host, delay)
+		}
+	}
+
 	var wg sync.WaitGroup
 	var mu sync.Mutex
+	var results []fetchResult
 	hadError := false
 
 	// Start worker pool
@@ -66,103 +311,290 @@ func main() {
 		go func() {
 			defer wg.Done()
 			for task := range tasks {
-				if err := fetchOne(task.dir, task.url, today, metadata, &mu); err != nil {
-					log.Printf("Error fetching %s: %v", task.url, err)
-					mu.Lock()
+				result := fetchOne(task.store, task.prefix, task.url, today, metadata, client)
+				if result.Err != nil {
+					ghError("fetching %s: %v", task.url, result.Err)
+				}
+				mu.Lock()
+				results = append(results, result)
+				if result.Err != nil {
 					hadError = true
-					mu.Unlock()
 				}
+				mu.Unlock()
 			}
 		}()
 	}
 
 	// Dispatch tasks
 	for dir, urls := range dataSources {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Failed to create directory %s: %v", dir, err)
+		store, prefix, err := resolveStorage(dir)
+		if err != nil {
+			log.Fatalf("Failed to set up storage for %s: %v", dir, err)
+		}
+		if _, ok := store.(localStorage); ok {
+			if err := os.MkdirAll(prefix, 0755); err != nil {
+				log.Fatalf("Failed to create directory %s: %v", prefix, err)
+			}
 		}
 		for _, url := range urls {
-			tasks <- fetchTask{dir: dir, url: url}
+			tasks <- fetchTask{store: store, prefix: prefix, url: url}
 		}
 	}
 	close(tasks)
 	wg.Wait()
 
-	writeMetadata(metadata)
+	if err := metadata.Close(); err != nil {
+		log.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if err := writeJobSummary(results); err != nil {
+		log.Printf("Failed to write job summary: %v", err)
+	}
+	if err := writeOutputs(summaryCounts(results)); err != nil {
+		log.Printf("Failed to write outputs: %v", err)
+	}
 
 	if hadError {
 		os.Exit(1)
 	}
 }
 
-func fetchOne(dir, url, today string, metadata Metadata, mu *sync.Mutex) error {
-	log.Printf("Checking %s", url)
+// summaryCounts tallies results by status into the updated_count,
+// unchanged_count and error_count output variables.
+func summaryCounts(results []fetchResult) map[string]string {
+	var updated, unchanged, errored int
+	for _, r := range results {
+		switch r.Status {
+		case statusUpdated:
+			updated++
+		case statusUnchanged:
+			unchanged++
+		case statusErrored:
+			errored++
+		}
+	}
+	return map[string]string{
+		"updated_count":   fmt.Sprint(updated),
+		"unchanged_count": fmt.Sprint(unchanged),
+		"error_count":     fmt.Sprint(errored),
+	}
+}
 
-	mu.Lock()
-	meta := metadata[url]
-	mu.Unlock()
+func fetchOne(store Storage, prefix, url, today string, metadata MetadataStore, client *http.Client) (result fetchResult) {
+	start := time.Now()
+	result = fetchResult{URL: url}
+	defer func() { result.Elapsed = time.Since(start) }()
 
-	req, err := http.NewRequest("GET", url, nil)
+	gh := newFetchLog(url)
+	defer gh.flush()
+
+	fail := func(err error) fetchResult {
+		result.Status = statusErrored
+		result.Err = err
+		return result
+	}
+
+	gh.notice("Checking %s", url)
+
+	meta, _, err := metadata.Get(url)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	if meta.LastModified != "" {
-		req.Header.Set("If-Modified-Since", meta.LastModified)
+
+	base := filepath.Base(url)
+	name := strings.TrimSuffix(base, ".csv") + "-" + today + ".csv"
+
+	_, isLocal := store.(localStorage)
+	outPath := joinKey(prefix, name)
+	if isLocal {
+		outPath = filepath.Join(prefix, name)
 	}
-	if meta.ETag != "" {
-		req.Header.Set("If-None-Match", meta.ETag)
+
+	hasher := sha256.New()
+	var wc io.WriteCloser
+	var tmpPath string
+	var resumeFrom int64
+
+	if isLocal && meta.InProgressFile != "" {
+		resumed := false
+		if info, statErr := os.Stat(meta.InProgressFile); statErr == nil {
+			if info.Size() == meta.InProgressOffset {
+				if acceptsRanges, _, probeErr := probeRangeSupport(client, url); probeErr == nil && acceptsRanges {
+					if f, openErr := os.OpenFile(meta.InProgressFile, os.O_WRONLY|os.O_APPEND, 0o644); openErr == nil {
+						if existing, readErr := os.Open(meta.InProgressFile); readErr == nil {
+							io.Copy(hasher, existing)
+							existing.Close()
+						}
+						// Wrap in localTempFile, the same as localStorage.Create,
+						// so this resumed file satisfies Discard()/Name() like
+						// any other temp file the rest of fetchOne deals with.
+						wc, tmpPath, resumeFrom = &localTempFile{f}, meta.InProgressFile, meta.InProgressOffset
+						gh.notice("Resuming %s from byte %d", url, resumeFrom)
+						resumed = true
+					}
+				}
+			}
+			if !resumed {
+				// The recorded offset no longer matches what's on disk, the
+				// host doesn't support range requests, or we couldn't
+				// reopen the file: this partial can't be resumed, and
+				// newMeta won't carry InProgressFile forward, so clean it
+				// up now instead of leaving it orphaned on disk.
+				os.Remove(meta.InProgressFile)
+			}
+		}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return err
+		return fail(err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotModified {
-		log.Printf("Not modified: %s", url)
-		return nil
+	if resumeFrom > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+		// If-Range ties the Range request to the exact version of the file
+		// our partial bytes came from. Without it, a server that changed
+		// in between would still honour the Range and send us bytes N- of
+		// the new version, which we'd splice onto the old partial and call
+		// a valid snapshot. With it, a changed resource falls back to a
+		// plain 200 with the full new body, which the StatusOK case below
+		// already treats as "discard the partial and start fresh".
+		if meta.ETag != "" {
+			req.Header.Set("If-Range", meta.ETag)
+		} else if meta.LastModified != "" {
+			req.Header.Set("If-Range", meta.LastModified)
+		}
+	} else {
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected response: %s", resp.Status)
+
+	resp, err := doWithRetry(client, req)
+	if err != nil {
+		return fail(err)
 	}
+	defer resp.Body.Close()
 
-	base := filepath.Base(url)
-	outPath := filepath.Join(dir, strings.TrimSuffix(base, ".csv")+"-"+today+".csv")
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		gh.notice("Not modified: %s", url)
+		result.Status = statusUnchanged
+		result.CacheHit = true
+		result.Bytes = meta.Size
+		return result
+	case http.StatusPartialContent:
+		// Server honoured our Range request; wc/tmpPath/resumeFrom are
+		// already set up to append.
+	case http.StatusOK:
+		if wc != nil {
+			// Either the server ignored our Range header, or (with
+			// If-Range set) the resource changed since we saved the
+			// partial and it sent the current full body instead of a 206.
+			// Either way our partial bytes no longer belong at the front
+			// of this response, so discard them and start over.
+			wc.Close()
+			os.Remove(tmpPath)
+			hasher.Reset()
+		}
+		wc, err = store.Create(outPath)
+		if err != nil {
+			return fail(err)
+		}
+		tmpPath = outPath
+		if n, ok := wc.(interface{ Name() string }); ok {
+			tmpPath = n.Name()
+		}
+		resumeFrom = 0
+	default:
+		if wc != nil {
+			wc.Close()
+		}
+		return fail(fmt.Errorf("unexpected response: %s", resp.Status))
+	}
 
-	tmpFile, err := os.CreateTemp(dir, "tmp")
-	if err != nil {
-		return err
+	if isLocal {
+		// Merge into the existing entry rather than overwriting it, so a
+		// crash mid-download doesn't also lose the content hash/ETag/
+		// Last-Modified this URL needs for its next conditional GET or
+		// content-hash dedupe.
+		checkpoint := meta
+		checkpoint.InProgressFile = tmpPath
+		checkpoint.InProgressOffset = resumeFrom
+		if err := metadata.Put(url, checkpoint); err != nil {
+			gh.warning("Failed to record in-progress download for %s: %v", url, err)
+		}
 	}
-	defer os.Remove(tmpFile.Name())
 
-	_, err = io.Copy(tmpFile, resp.Body)
-	tmpFile.Close()
+	var lastPersisted int64
+	written, err := copyWithProgress(wc, io.TeeReader(resp.Body, hasher), func(total int64) {
+		if !isLocal || total-lastPersisted < 4<<20 {
+			return
+		}
+		lastPersisted = total
+		checkpoint := meta
+		checkpoint.InProgressFile = tmpPath
+		checkpoint.InProgressOffset = resumeFrom + total
+		metadata.Put(url, checkpoint)
+	})
+	closeErr := wc.Close()
 	if err != nil {
-		return err
+		return fail(err)
 	}
-
-	if err := os.Rename(tmpFile.Name(), outPath); err != nil {
-		return err
+	if closeErr != nil {
+		return fail(closeErr)
 	}
-	log.Printf("Downloaded: %s → %s", url, outPath)
+	size := resumeFrom + written
+	sum := hex.EncodeToString(hasher.Sum(nil))
 
-	// Update metadata
-	newMeta := MetadataEntry{}
+	newMeta := MetadataEntry{
+		ContentSHA256: sum,
+		Size:          size,
+		LastFetchedAt: time.Now(),
+	}
 	if lm := resp.Header.Get("Last-Modified"); lm != "" {
-		if t, err := http.ParseTime(lm); err == nil {
-			os.Chtimes(outPath, time.Now(), t)
-			newMeta.LastModified = lm
-		}
+		newMeta.LastModified = lm
 	}
 	if etag := resp.Header.Get("ETag"); etag != "" {
 		newMeta.ETag = etag
 	}
 
-	mu.Lock()
-	metadata[url] = newMeta
-	mu.Unlock()
-	return nil
+	if meta.ContentSHA256 != "" && meta.ContentSHA256 == sum {
+		// Met Éireann occasionally returns 200 OK with unchanged bytes and no
+		// usable validators, so fall back to content hashing: same hash means
+		// there's nothing new to archive, just refresh the fetch metadata.
+		if d, ok := wc.(interface{ Discard() error }); ok {
+			if err := d.Discard(); err != nil {
+				gh.warning("Failed to discard temp object for %s: %v", url, err)
+			}
+		}
+		gh.notice("Unchanged (content hash match): %s", url)
+		result.Status = statusUnchanged
+		result.Bytes = size
+		if err := metadata.Put(url, newMeta); err != nil {
+			return fail(err)
+		}
+		return result
+	}
+
+	if err := store.Rename(tmpPath, outPath); err != nil {
+		return fail(err)
+	}
+	if _, ok := store.(localStorage); ok && newMeta.LastModified != "" {
+		if t, err := http.ParseTime(newMeta.LastModified); err == nil {
+			os.Chtimes(outPath, time.Now(), t)
+		}
+	}
+	gh.notice("Downloaded: %s → %s", url, outPath)
+
+	result.Status = statusUpdated
+	result.Bytes = size
+	if err := metadata.Put(url, newMeta); err != nil {
+		return fail(err)
+	}
+	return result
 }
 
 func readDataSources() DataSources {
@@ -179,38 +611,17 @@ func readDataSources() DataSources {
 	return ds
 }
 
-func readMetadata() Metadata {
-	file, err := os.Open(metadataFile)
-	if os.IsNotExist(err) {
-		return Metadata{}
-	} else if err != nil {
-		log.Fatalf("Failed to read metadata: %v", err)
-	}
-	defer file.Close()
-
-	var m Metadata
-	if err := yaml.NewDecoder(file).Decode(&m); err != nil {
-		log.Fatalf("Failed to parse metadata: %v", err)
-	}
-	return m
-}
-
-func writeMetadata(m Metadata) {
-	tmp := metadataFile + ".tmp"
-	f, err := os.Create(tmp)
-	if err != nil {
-		log.Fatalf("Failed to write metadata: %v", err)
-	}
-	defer f.Close()
-
-	enc := yaml.NewEncoder(f)
-	enc.SetIndent(2)
-	if err := enc.Encode(m); err != nil {
-		log.Fatalf("Failed to encode metadata: %v", err)
-	}
-	enc.Close()
-
-	if err := os.Rename(tmp, metadataFile); err != nil {
-		log.Fatalf("Failed to move metadata file: %v", err)
+// hostsOf returns the set of distinct hosts across every URL in
+// dataSources, so the crawl-delay lookup at startup only hits each host
+// once regardless of how many files it serves.
+func hostsOf(dataSources DataSources) map[string]struct{} {
+	hosts := make(map[string]struct{})
+	for _, urls := range dataSources {
+		for _, rawURL := range urls {
+			if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+				hosts[u.Host] = struct{}{}
+			}
+		}
 	}
+	return hosts
 }
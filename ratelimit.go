@@ -0,0 +1,260 @@
+// Copyright 2025 Stephen Connolly
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostConcurrencyEnv = "HOST_CONCURRENCY" // max in-flight requests per host
+	hostIntervalEnv    = "HOST_INTERVAL_MS" // min milliseconds between requests to the same host
+	globalQPSEnv       = "GLOBAL_QPS"       // optional cap on requests/sec across all hosts combined
+	defaultHostLimit   = 2
+	defaultHostDelay   = time.Second
+
+	moduleVersion = "0.6.0"
+)
+
+// userAgent identifies the archiver to the servers it polls, so an admin
+// who notices the traffic can find out what it is and how to reach us.
+var userAgent = fmt.Sprintf("ireland-weather-data/%s (+https://github.com/stephenc/ireland-weather-data)", moduleVersion)
+
+// HostLimiter makes the fetcher a polite crawler: it caps how many requests
+// may be in flight to a given host at once, enforces a minimum spacing
+// between requests to that host (a per-host token bucket seeded from either
+// the default delay or that host's robots.txt Crawl-delay, whichever is
+// longer), and optionally throttles the combined request rate across every
+// host to a fixed QPS. Safe for concurrent use.
+type HostLimiter struct {
+	defaultLimit   int
+	defaultDelay   time.Duration
+	globalInterval time.Duration // 0 disables the global cap
+
+	mu    sync.Mutex
+	hosts map[string]*hostBucket
+
+	globalMu   sync.Mutex
+	globalNext time.Time
+}
+
+type hostBucket struct {
+	sem chan struct{}
+
+	mu   sync.Mutex
+	next time.Time
+	// interval is the minimum spacing between requests. It starts at the
+	// limiter's defaultDelay and can only be raised, by raiseInterval.
+	interval time.Duration
+}
+
+// newHostLimiterFromEnv builds a HostLimiter from HOST_CONCURRENCY,
+// HOST_INTERVAL_MS and GLOBAL_QPS, falling back to defaultHostLimit
+// in-flight requests and a defaultHostDelay spacing per host with no
+// global cap.
+func newHostLimiterFromEnv() *HostLimiter {
+	concurrency := envInt(hostConcurrencyEnv, defaultHostLimit)
+	interval := defaultHostDelay
+	if ms := envInt(hostIntervalEnv, -1); ms >= 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	var globalInterval time.Duration
+	if qps := envFloat(globalQPSEnv); qps > 0 {
+		globalInterval = time.Duration(float64(time.Second) / qps)
+	}
+
+	return &HostLimiter{
+		defaultLimit:   concurrency,
+		defaultDelay:   interval,
+		globalInterval: globalInterval,
+		hosts:          make(map[string]*hostBucket),
+	}
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func envFloat(name string) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// bucketFor returns the hostBucket for host, creating it on first use.
+func (l *HostLimiter) bucketFor(host string) *hostBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.hosts[host]
+	if !ok {
+		b = &hostBucket{sem: make(chan struct{}, l.defaultLimit), interval: l.defaultDelay}
+		l.hosts[host] = b
+	}
+	return b
+}
+
+// raiseInterval widens a host's minimum spacing, e.g. to honour a
+// robots.txt Crawl-delay longer than our default. It may be called after
+// requests to host have gone out: the time already reserved for host's next
+// request is kept, and the new spacing applies from that request on.
+func (l *HostLimiter) raiseInterval(host string, d time.Duration) {
+	b := l.bucketFor(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d > b.interval {
+		b.interval = d
+	}
+}
+
+// Wait blocks until it's polite to send a request to host, reserving a
+// concurrency slot that the caller must release exactly once by calling the
+// returned func.
+func (l *HostLimiter) Wait(host string) func() {
+	l.waitGlobal()
+
+	b := l.bucketFor(host)
+	b.sem <- struct{}{}
+	b.waitTurn()
+
+	return func() { <-b.sem }
+}
+
+func (l *HostLimiter) waitGlobal() {
+	if l.globalInterval == 0 {
+		return
+	}
+	l.globalMu.Lock()
+	defer l.globalMu.Unlock()
+	now := time.Now()
+	if now.Before(l.globalNext) {
+		time.Sleep(l.globalNext.Sub(now))
+		now = time.Now()
+	}
+	l.globalNext = now.Add(l.globalInterval)
+}
+
+func (b *hostBucket) waitTurn() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Before(b.next) {
+		time.Sleep(b.next.Sub(now))
+		now = time.Now()
+	}
+	b.next = now.Add(b.interval)
+}
+
+// rateLimitedTransport wraps an http.RoundTripper so every request is
+// throttled through a HostLimiter and carries our User-Agent, without every
+// call site having to remember to do either. The host's concurrency slot is
+// held until RoundTrip returns, that is until the response headers arrive;
+// reading the response body afterwards does not count against the limit.
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *HostLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release := t.limiter.Wait(req.URL.Host)
+	defer release()
+
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// newPoliteClient returns an http.Client whose requests are throttled per
+// host (and optionally globally) by limiter and that identify themselves
+// with userAgent.
+func newPoliteClient(limiter *HostLimiter) *http.Client {
+	return &http.Client{Transport: &rateLimitedTransport{next: http.DefaultTransport, limiter: limiter}}
+}
+
+// crawlDelayFor fetches host's robots.txt over client and returns the
+// Crawl-delay directive that applies to us (the first User-agent: * block),
+// or 0 if the host publishes no robots.txt, has no such directive, or can't
+// be reached. A source with no published policy isn't treated as refusing
+// us; it just gets our default pacing.
+func crawlDelayFor(client *http.Client, host string) time.Duration {
+	resp, err := client.Get("https://" + host + "/robots.txt")
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	return parseCrawlDelay(resp.Body)
+}
+
+// parseCrawlDelay reads a robots.txt body and returns the Crawl-delay (in
+// seconds, per the de facto convention most crawlers follow) declared under
+// the first "User-agent: *" block, or 0 if there isn't one. It's a small,
+// forgiving parser: we only care about the one directive, not full group
+// or wildcard matching.
+func parseCrawlDelay(r io.Reader) time.Duration {
+	scanner := bufio.NewScanner(r)
+	inWildcardBlock := false
+	var delay time.Duration
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			inWildcardBlock = value == "*"
+		case "crawl-delay":
+			if inWildcardBlock {
+				if secs, err := strconv.ParseFloat(value, 64); err == nil {
+					delay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+	return delay
+}
@@ -0,0 +1,156 @@
+// Copyright 2025 Stephen Connolly
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxFetchAttempts = 5
+	retryBaseDelay   = 500 * time.Millisecond
+	retryMaxDelay    = 30 * time.Second
+)
+
+// doWithRetry issues req (cloning it for each attempt, since GET requests
+// have no body to worry about) and retries on 5xx, 429, and transient
+// network errors using jittered exponential backoff. A Retry-After header
+// on a 429/503 response takes priority over the computed backoff.
+func doWithRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	var lastErr error
+	retryAfterSlept := false
+	for attempt := 0; attempt < maxFetchAttempts; attempt++ {
+		if attempt > 0 && !retryAfterSlept {
+			time.Sleep(retryDelay(attempt))
+		}
+		retryAfterSlept = false
+
+		resp, err := client.Do(req.Clone(req.Context()))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if isRetryableStatus(resp.StatusCode) && attempt < maxFetchAttempts-1 {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			if retryAfter > 0 {
+				time.Sleep(retryAfter)
+				retryAfterSlept = true
+			}
+			lastErr = &statusError{status: resp.Status, code: resp.StatusCode}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+type statusError struct {
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string { return "unexpected response: " + e.status }
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt-1)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	// Full jitter: spreads out retries from many workers hitting the same
+	// host at once after a shared failure (e.g. a transient 503).
+	jittered := time.Duration(rand.Int63n(int64(delay)))
+	return jittered
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// copyWithProgress is like io.Copy but invokes onProgress with the running
+// byte count after every chunk, so callers can checkpoint long transfers.
+func copyWithProgress(dst io.Writer, src io.Reader, onProgress func(total int64)) (int64, error) {
+	buf := make([]byte, 1<<20)
+	var total int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+			onProgress(total)
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// probeRangeSupport issues a lightweight Range request to learn whether the
+// server will let us resume a partial download, without committing to
+// fetching the whole body.
+func probeRangeSupport(client *http.Client, rawURL string) (acceptsRanges bool, contentLength int64, err error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := doWithRetry(client, req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPartialContent {
+		return true, parseContentRangeTotal(resp.Header.Get("Content-Range")), nil
+	}
+	return false, resp.ContentLength, nil
+}
+
+func parseContentRangeTotal(contentRange string) int64 {
+	// Format: "bytes 0-0/12345" (or "*" for unknown total).
+	_, totalStr, ok := strings.Cut(contentRange, "/")
+	if !ok || totalStr == "*" {
+		return -1
+	}
+	n, err := strconv.ParseInt(totalStr, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,264 @@
+// Copyright 2025 Stephen Connolly
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage is a write-through abstraction over a place archived snapshots
+// live, whether that's the local filesystem or a cloud object store. Every
+// backend preserves the fetcher's atomic-temp-then-rename pattern: callers
+// write the full body via Create, and the write is only made visible under
+// its final name once Rename succeeds.
+type Storage interface {
+	// Create opens a new, uncommitted object/file for writing. The data
+	// written to it must not be visible at its final name until Rename is
+	// called with the same path.
+	Create(path string) (io.WriteCloser, error)
+	// Rename atomically (per-backend) moves a path written via Create to its
+	// final name, discarding any previous temp state.
+	Rename(oldPath, newPath string) error
+}
+
+// resolveStorage inspects a data-sources.yaml directory key and returns the
+// Storage backend that owns it along with the path prefix snapshots for
+// that key should be written under. Local directories (no "scheme://"
+// prefix) continue to use the filesystem exactly as before.
+func resolveStorage(dir string) (Storage, string, error) {
+	switch {
+	case strings.HasPrefix(dir, "s3://"):
+		rest := strings.TrimPrefix(dir, "s3://")
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		store, err := newS3Storage(bucket)
+		return store, prefix, err
+	case strings.HasPrefix(dir, "azblob://"):
+		rest := strings.TrimPrefix(dir, "azblob://")
+		container, prefix, _ := strings.Cut(rest, "/")
+		store, err := newAzureBlobStorage(container)
+		return store, prefix, err
+	case strings.HasPrefix(dir, "gcs://"):
+		rest := strings.TrimPrefix(dir, "gcs://")
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		store, err := newGCSStorage(bucket)
+		return store, prefix, err
+	default:
+		return localStorage{}, dir, nil
+	}
+}
+
+// localStorage is the original behaviour: write to a temp file in the
+// target directory, then os.Rename into place.
+type localStorage struct{}
+
+func (localStorage) Create(p string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(filepath.Dir(p), "tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &localTempFile{f}, nil
+}
+
+func (localStorage) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+type localTempFile struct{ *os.File }
+
+func (f *localTempFile) Discard() error { return os.Remove(f.Name()) }
+
+// s3Storage uploads to an S3 bucket, finalizing the object only once the
+// whole body has been copied.
+type s3Storage struct {
+	bucket string
+	client *s3.Client
+}
+
+func newS3Storage(bucket string) (*s3Storage, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return &s3Storage{bucket: bucket, client: s3.NewFromConfig(cfg)}, nil
+}
+
+func (s *s3Storage) Create(key string) (io.WriteCloser, error) {
+	tmpKey := key + ".tmp"
+	pr, pw := io.Pipe()
+	uploader := manager.NewUploader(s.client)
+	done := make(chan error, 1)
+	go func() {
+		_, err := uploader.Upload(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(tmpKey),
+			Body:   pr,
+		})
+		// If the upload stopped reading early (error or not), make sure pr
+		// reflects that: otherwise a Write already blocked on pr filling up
+		// would hang forever waiting for a Read that will never come.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &pipeWriteCloser{w: pw, key: tmpKey, done: done, discard: func() error {
+		_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(tmpKey)})
+		return err
+	}}, nil
+}
+
+func (s *s3Storage) Rename(oldKey, newKey string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String(s.bucket + "/" + oldKey),
+	})
+	if err != nil {
+		return fmt.Errorf("finalize s3://%s/%s: %w", s.bucket, newKey, err)
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(oldKey),
+	})
+	return err
+}
+
+// azureBlobStorage uploads to an Azure Blob container.
+type azureBlobStorage struct {
+	container string
+	client    *azblob.Client
+}
+
+func newAzureBlobStorage(container string) (*azureBlobStorage, error) {
+	client, err := azblob.NewClientFromConnectionString(os.Getenv("AZURE_STORAGE_CONNECTION_STRING"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create azure blob client from AZURE_STORAGE_CONNECTION_STRING: %w", err)
+	}
+	return &azureBlobStorage{container: container, client: client}, nil
+}
+
+func (a *azureBlobStorage) Create(blobName string) (io.WriteCloser, error) {
+	tmpName := blobName + ".tmp"
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.client.UploadStream(context.Background(), a.container, tmpName, pr, nil)
+		// If the upload stopped reading early (error or not), make sure pr
+		// reflects that: otherwise a Write already blocked on pr filling up
+		// would hang forever waiting for a Read that will never come.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &pipeWriteCloser{w: pw, key: tmpName, done: done, discard: func() error {
+		_, err := a.client.DeleteBlob(context.Background(), a.container, tmpName, nil)
+		return err
+	}}, nil
+}
+
+func (a *azureBlobStorage) Rename(oldBlob, newBlob string) error {
+	ctx := context.Background()
+	srcClient := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(oldBlob)
+	dstClient := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(newBlob)
+	if _, err := dstClient.StartCopyFromURL(ctx, srcClient.URL(), nil); err != nil {
+		return fmt.Errorf("finalize azblob://%s/%s: %w", a.container, newBlob, err)
+	}
+	_, err := a.client.DeleteBlob(ctx, a.container, oldBlob, nil)
+	return err
+}
+
+// gcsStorage uploads to a Google Cloud Storage bucket. GCS object writes are
+// already only visible once the writer is closed successfully, but we still
+// write to a temp object name and copy it into place so a crash mid-upload
+// never leaves a partial object under the final name.
+type gcsStorage struct {
+	bucket string
+	client *storage.Client
+}
+
+func newGCSStorage(bucket string) (*gcsStorage, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("create GCS client: %w", err)
+	}
+	return &gcsStorage{bucket: bucket, client: client}, nil
+}
+
+func (g *gcsStorage) Create(objectName string) (io.WriteCloser, error) {
+	tmpName := objectName + ".tmp"
+	w := g.client.Bucket(g.bucket).Object(tmpName).NewWriter(context.Background())
+	return &gcsWriteCloser{w: w, key: tmpName, bucket: g.client.Bucket(g.bucket)}, nil
+}
+
+func (g *gcsStorage) Rename(oldObject, newObject string) error {
+	ctx := context.Background()
+	src := g.client.Bucket(g.bucket).Object(oldObject)
+	dst := g.client.Bucket(g.bucket).Object(newObject)
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		return fmt.Errorf("finalize gcs://%s/%s: %w", g.bucket, newObject, err)
+	}
+	return src.Delete(ctx)
+}
+
+// pipeWriteCloser adapts the background-goroutine-upload pattern shared by
+// the S3 and Azure backends (both SDKs want to read the body from a single
+// blocking Reader rather than being fed chunk by chunk) to io.WriteCloser.
+type pipeWriteCloser struct {
+	w       *io.PipeWriter
+	key     string
+	done    chan error
+	discard func() error
+}
+
+func (p *pipeWriteCloser) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *pipeWriteCloser) Discard() error { return p.discard() }
+
+func (p *pipeWriteCloser) Close() error {
+	if err := p.w.Close(); err != nil {
+		return err
+	}
+	return <-p.done
+}
+
+func (p *pipeWriteCloser) Name() string { return p.key }
+
+type gcsWriteCloser struct {
+	w      *storage.Writer
+	key    string
+	bucket *storage.BucketHandle
+}
+
+func (g *gcsWriteCloser) Write(b []byte) (int, error) { return g.w.Write(b) }
+func (g *gcsWriteCloser) Close() error                { return g.w.Close() }
+func (g *gcsWriteCloser) Name() string                { return g.key }
+func (g *gcsWriteCloser) Discard() error              { return g.bucket.Object(g.key).Delete(context.Background()) }
+
+// joinKey joins a storage prefix and a file name the way object stores
+// expect: forward slashes, no leading slash.
+func joinKey(prefix, name string) string {
+	return strings.TrimPrefix(path.Join(prefix, name), "/")
+}